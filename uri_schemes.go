@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+)
+
+// URISchemeHandler adapts clientToServerURI/serverToClientURI and
+// WalkURIFields to a particular URI scheme. Language servers like Eclipse
+// JDT (jdt://) and Metals (zip:) emit URIs whose scheme and path the proxy
+// has no workspace-folder mapping for, and which must therefore survive
+// the proxy untouched rather than being run through the file:// cache-dir
+// rewrite.
+type URISchemeHandler interface {
+	// ClientToServer rewrites a client-side URI of this scheme into the
+	// form the downstream server should see.
+	ClientToServer(uri lsp.DocumentURI, folders []folderMapping) lsp.DocumentURI
+	// ServerToClient rewrites a server-side URI of this scheme back into
+	// the form the client should see.
+	ServerToClient(uri lsp.DocumentURI, folders []folderMapping) lsp.DocumentURI
+	// ShouldWalk reports whether WalkURIFields should treat a field holding
+	// this URI as a document URI to rewrite.
+	ShouldWalk(uri lsp.DocumentURI) bool
+}
+
+var uriSchemeHandlers = map[string]URISchemeHandler{
+	"":         fileSchemeHandler{},
+	"file":     fileSchemeHandler{},
+	"jdt":      passthroughSchemeHandler{},
+	"untitled": passthroughSchemeHandler{},
+	// zip: URIs into jar contents (as emitted by Metals) are passed through
+	// untouched: the inner path after "!/" is relative to the jar's own
+	// root, not to any workspace folder, so there's no folder-relative
+	// rewrite to apply, and the jar itself isn't cloned into a workspace
+	// folder's cache dir either.
+	"zip": passthroughSchemeHandler{},
+}
+
+// RegisterURISchemeHandler installs a handler for the given URI scheme,
+// overriding any existing handler for it. The adapter's main package uses
+// this to plug in support for downstream servers that emit schemes beyond
+// the built-in ones.
+func RegisterURISchemeHandler(scheme string, handler URISchemeHandler) {
+	uriSchemeHandlers[scheme] = handler
+}
+
+// schemeHandlerFor parses uri and looks up the handler registered for its
+// scheme. It returns a nil handler (not an error) for schemes with no
+// registered handler, so callers can pass the URI through untouched.
+func schemeHandlerFor(uri lsp.DocumentURI) (URISchemeHandler, *url.URL, error) {
+	parsedURI, err := url.Parse(string(uri))
+	if err != nil {
+		return nil, nil, err
+	}
+	return uriSchemeHandlers[parsedURI.Scheme], parsedURI, nil
+}
+
+// fileSchemeHandler is the original file:// behavior: paths are routed
+// through the folder cache-dir mapping.
+type fileSchemeHandler struct{}
+
+func (fileSchemeHandler) ClientToServer(uri lsp.DocumentURI, folders []folderMapping) lsp.DocumentURI {
+	return rewriteFileURI(uri, folders, true)
+}
+
+func (fileSchemeHandler) ServerToClient(uri lsp.DocumentURI, folders []folderMapping) lsp.DocumentURI {
+	return rewriteFileURI(uri, folders, false)
+}
+
+func (fileSchemeHandler) ShouldWalk(lsp.DocumentURI) bool { return true }
+
+// passthroughSchemeHandler leaves a URI untouched. It is used for opaque
+// schemes like jdt:// classfile references and untitled: buffers, whose
+// identifiers the downstream server must see verbatim.
+type passthroughSchemeHandler struct{}
+
+func (passthroughSchemeHandler) ClientToServer(uri lsp.DocumentURI, _ []folderMapping) lsp.DocumentURI {
+	return uri
+}
+
+func (passthroughSchemeHandler) ServerToClient(uri lsp.DocumentURI, _ []folderMapping) lsp.DocumentURI {
+	return uri
+}
+
+func (passthroughSchemeHandler) ShouldWalk(lsp.DocumentURI) bool { return true }
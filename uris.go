@@ -7,25 +7,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"reflect"
 	"strings"
 
 	"github.com/sourcegraph/go-langserver/pkg/lsp"
-
-	"github.com/pkg/errors"
 )
 
-func (p *cloneProxy) cloneWorkspaceToCache(globs []string) error {
-	fs := &remoteFS{conn: p.client, traceID: p.sessionID.String()}
-	err := fs.Clone(p.ctx, p.workspaceCacheDir(), globs)
-	if err != nil {
-		return errors.Wrap(err, "failed to clone workspace to local cache")
-	}
-
-	log.Printf("Cloned workspace to %s", p.workspaceCacheDir())
-	return nil
-}
-
 func (p *cloneProxy) cleanWorkspaceCache() error {
 	log.Printf("Removing workspace cache from %s", p.workspaceCacheDir())
 	return os.RemoveAll(p.workspaceCacheDir())
@@ -35,62 +21,131 @@ func (p *cloneProxy) workspaceCacheDir() string {
 	return filepath.Join(*cacheDir, p.sessionID.String())
 }
 
-func clientToServerURI(uri lsp.DocumentURI, sysCacheDir string) lsp.DocumentURI {
-	// sysCacheDir needs to be converted from a local path to a URI path
-	cacheDir := filepath.ToSlash(sysCacheDir)
-
-	parsedURI, err := url.Parse(string(uri))
+// folderMapping pairs a client-side workspace folder with the directory it
+// is cloned into under workspaceCacheDir(). clientToServerURI and
+// serverToClientURI route a URI through whichever folder's prefix it falls
+// under, so a single proxy session can span multiple workspace roots.
+type folderMapping struct {
+	ClientURI lsp.DocumentURI
+	CacheDir  string
+}
 
+func clientToServerURI(uri lsp.DocumentURI, folders []folderMapping) lsp.DocumentURI {
+	handler, parsedURI, err := schemeHandlerFor(uri)
 	if err != nil {
 		log.Println(fmt.Sprintf("clientToServerURI: err when trying to parse uri %s", uri), err)
 		return uri
 	}
-
-	if !probablyFileURI(parsedURI) {
+	if handler == nil || parsedURI.Path == "" {
 		return uri
 	}
 
-	// We assume that any path provided by the client to the server
-	// is a project path that is relative to '/'
-	parsedURI.Path = path.Join(cacheDir, parsedURI.Path)
-	return lsp.DocumentURI(parsedURI.String())
+	return handler.ClientToServer(uri, folders)
 }
 
-func serverToClientURI(uri lsp.DocumentURI, sysCacheDir string) lsp.DocumentURI {
-	// sysCacheDir needs to be converted from a local path to a URI path
-	cacheDir := filepath.ToSlash(sysCacheDir)
+func serverToClientURI(uri lsp.DocumentURI, folders []folderMapping) lsp.DocumentURI {
+	handler, parsedURI, err := schemeHandlerFor(uri)
+	if err != nil {
+		log.Println(fmt.Sprintf("serverToClientURI: err when trying to parse uri %s", uri), err)
+		return uri
+	}
+	if handler == nil || parsedURI.Path == "" {
+		return uri
+	}
 
-	parsedURI, err := url.Parse(string(uri))
+	return handler.ServerToClient(uri, folders)
+}
 
+// rewriteFileURI implements the file:// rewriting that clientToServerURI
+// and serverToClientURI used to do directly: a URI is routed through
+// whichever folder's prefix it falls under. When toServer is true, only
+// uris under one of the client-side folder URIs are rewritten; when it is
+// false, only uris that point to a location in one of the workspace folder
+// caches are. Any other uri is returned unchanged.
+func rewriteFileURI(uri lsp.DocumentURI, folders []folderMapping, toServer bool) lsp.DocumentURI {
+	parsedURI, err := url.Parse(string(uri))
 	if err != nil {
-		log.Println(fmt.Sprintf("serverToClientURI: err when trying to parse uri %s", uri), err)
+		log.Println(fmt.Sprintf("rewriteFileURI: err when trying to parse uri %s", uri), err)
 		return uri
 	}
 
-	if !probablyFileURI(parsedURI) {
+	folder, prefix := bestMatchingFolder(parsedURI.Path, folders, toServer)
+	if folder == nil {
 		return uri
 	}
 
-	// Only rewrite uris that point to a location in the workspace cache. If it does
-	// point to a cache location, then we assume that the path points to a location in the
-	// project.
-	if pathHasPrefix(parsedURI.Path, cacheDir) {
-		parsedURI.Path = path.Join("/", pathTrimPrefix(parsedURI.Path, cacheDir))
+	clientURI, err := url.Parse(string(folder.ClientURI))
+	if err != nil {
+		log.Println(fmt.Sprintf("rewriteFileURI: err when trying to parse folder uri %s", folder.ClientURI), err)
+		return uri
 	}
 
+	rel := pathTrimPrefix(normalizeURIPath(parsedURI.Path), prefix)
+	if toServer {
+		parsedURI.Path = path.Join(filepath.ToSlash(folder.CacheDir), rel)
+	} else {
+		parsedURI.Path = path.Join(clientURI.Path, rel)
+	}
 	return lsp.DocumentURI(parsedURI.String())
 }
 
-func probablyFileURI(candidate *url.URL) bool {
-	if !(candidate.Scheme == "" || candidate.Scheme == "file") {
-		return false
+// bestMatchingFolder returns the folder whose prefix (the client URI's path
+// when byClientURI is true, otherwise the folder's cache dir) is the longest
+// match for p, along with that matching prefix already normalized and
+// (for cache dirs) symlink-resolved so callers don't need to redo it. It
+// returns a nil folder if none matches. Longest-prefix match is needed
+// because nested workspace folders (e.g. "/a" and "/a/b") would otherwise
+// be ambiguous.
+func bestMatchingFolder(p string, folders []folderMapping, byClientURI bool) (*folderMapping, string) {
+	p = normalizeURIPath(p)
+	var best *folderMapping
+	var bestPrefix string
+	bestLen := -1
+	for i := range folders {
+		prefix := normalizeURIPath(resolveSymlinksBestEffort(filepath.ToSlash(folders[i].CacheDir)))
+		if byClientURI {
+			clientURI, err := url.Parse(string(folders[i].ClientURI))
+			if err != nil {
+				continue
+			}
+			prefix = normalizeURIPath(clientURI.Path)
+		}
+		if pathHasPrefix(p, prefix) && len(prefix) > bestLen {
+			best = &folders[i]
+			bestPrefix = prefix
+			bestLen = len(prefix)
+		}
 	}
+	return best, bestPrefix
+}
 
-	if candidate.Path == "" {
-		return false
+// normalizeURIPath canonicalizes a URI path for case-insensitive
+// comparison by lowercasing a leading Windows drive letter ("/C:" ->
+// "/c:"). Callers always pass a path already run through url.Parse (or a
+// plain filesystem path), so it's already percent-decoded by the time it
+// gets here; there is no encoded drive-letter colon left to collapse.
+func normalizeURIPath(p string) string {
+	if len(p) >= 3 && p[0] == '/' && isASCIILetter(p[1]) && p[2] == ':' {
+		p = "/" + strings.ToLower(p[1:2]) + p[2:]
 	}
+	return p
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
 
-	return true
+// resolveSymlinksBestEffort resolves symlinks in p so a symlinked cache dir
+// still matches the real paths the downstream server reports back. It
+// returns p unchanged if the path doesn't exist or can't be resolved, since
+// cache-dir prefixes are compared before anything has necessarily been
+// written to disk.
+func resolveSymlinksBestEffort(p string) string {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return p
+	}
+	return filepath.ToSlash(resolved)
 }
 
 func pathHasPrefix(s, prefix string) bool {
@@ -128,64 +183,3 @@ func rawTrimPrefix(s, prefix, pathSep string) string {
 	}
 	return strings.TrimPrefix(s, prefix)
 }
-
-// WalkURIFields walks the LSP params/result object for fields
-// containing document URIs.
-//
-// If update is non-nil, it updates all document URIs in an LSP
-// params/result with the value of f(existingURI). Callers can use
-// this to rewrite paths in the params/result.
-func WalkURIFields(o interface{}, update func(lsp.DocumentURI) lsp.DocumentURI) {
-	var walk func(o interface{}, parent string)
-	walk = func(o interface{}, parent string) {
-		switch o := o.(type) {
-		case map[string]interface{}:
-			for k, v := range o { // Location, TextDocumentIdentifier, TextDocumentItem, etc.
-				// Handling "rootPath" and "rootUri" special cases the initialize method.
-				if k == "uri" || k == "rootPath" || k == "rootUri" || k == "url"{
-					s, ok := v.(string)
-					if !ok {
-						s2, ok2 := v.(lsp.DocumentURI)
-						s = string(s2)
-						ok = ok2
-					}
-					if ok {
-						if update != nil {
-							o[k] = update(lsp.DocumentURI(s))
-						}
-						continue
-					}
-				}
-				if parent == "changes" {
-					new_uri := update(lsp.DocumentURI(k))
-					delete(o, k)
-					o[string(new_uri)] = v
-				}
-				walk(v, k)
-			}
-		case []interface{}: // Location[]
-			for k, v := range o {
-				walk(v, string(k))
-			}
-		default: // structs with a "URI" field
-			rv := reflect.ValueOf(o)
-			if rv.Kind() == reflect.Ptr {
-				rv = rv.Elem()
-			}
-			if rv.Kind() == reflect.Struct {
-				if fv := rv.FieldByName("URI"); fv.Kind() == reflect.String {
-					if update != nil {
-						fv.SetString(string(update(lsp.DocumentURI(fv.String()))))
-					}
-				}
-				for i := 0; i < rv.NumField(); i++ {
-					fv := rv.Field(i)
-					if fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Struct || fv.Kind() == reflect.Array {
-						walk(fv.Interface(), "n/a")
-					}
-				}
-			}
-		}
-	}
-	walk(o, "top")
-}
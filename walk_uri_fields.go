@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+)
+
+// uriKeysByMethod maps an LSP method name to the JSON keys that hold a
+// document URI in that method's params/result. Looking keys up per method,
+// rather than treating any field anywhere in the tree named e.g. "uri" as
+// one, is the actual fix for the bug chunk0-4 exists to close: a field that
+// merely happens to share a name with a real URI field no longer gets
+// rewritten just because it showed up in an unrelated payload.
+//
+// This is not a full decode into concrete protocol structs: the vendored
+// go-langserver/pkg/lsp package predates LocationLink, DocumentLink,
+// ShowDocumentParams, ConfigurationItem, and the CreateFile/RenameFile/
+// DeleteFile arms of WorkspaceEdit.documentChanges, so there is no concrete
+// Go type here to decode those fields into. A method with no entry below
+// falls back to walkURIFieldsGeneric, the original key-name/reflective
+// walker, so messages from newer or unrecognized servers still get the old
+// best-effort treatment instead of being skipped outright.
+//
+// ShowDocumentParams's boolean "external" flag is deliberately not listed
+// here under any name: it isn't a URI field, just a hint about how the
+// client should open the "uri" field already covered below.
+var uriKeysByMethod = map[string][]string{
+	// initialize's params nest a "uri" at multiple levels (rootUri,
+	// workspaceFolders[].uri), in addition to the top-level rootPath.
+	"initialize":                      {"rootPath", "rootUri", "uri"},
+	"textDocument/definition":         {"uri", "targetUri"},
+	"textDocument/typeDefinition":     {"uri", "targetUri"},
+	"textDocument/implementation":     {"uri", "targetUri"},
+	"textDocument/declaration":        {"uri", "targetUri"},
+	"textDocument/references":         {"uri"},
+	"textDocument/documentSymbol":     {"uri"},
+	"textDocument/documentLink":       {"uri", "target"},
+	"textDocument/publishDiagnostics": {"uri"},
+	"textDocument/rename":             {"uri", "oldUri", "newUri"},
+	"workspace/symbol":                {"uri"},
+	"workspace/applyEdit":             {"uri", "oldUri", "newUri"},
+	"workspace/configuration":         {"scopeUri"},
+	"window/showDocument":             {"uri"},
+}
+
+// WalkURIFields walks the LSP params/result object for method, rewriting
+// fields that hold a document URI.
+//
+// If update is non-nil, it updates all document URIs in an LSP
+// params/result with the value of f(existingURI). Callers can use this to
+// rewrite paths in the params/result. A URI whose scheme handler reports
+// ShouldWalk == false (see uri_schemes.go) is left untouched, so opaque
+// identifiers the registry doesn't yet understand aren't corrupted.
+func WalkURIFields(o interface{}, method string, update func(lsp.DocumentURI) lsp.DocumentURI) {
+	if keys, ok := uriKeysByMethod[method]; ok {
+		walkURIFieldsByKeys(o, keys, update)
+		return
+	}
+	walkURIFieldsGeneric(o, update)
+}
+
+// walkURIFieldsByKeys walks o, rewriting values of exactly the given JSON
+// keys (plus WorkspaceEdit's "changes", which is keyed by URI rather than
+// holding one in a named field).
+func walkURIFieldsByKeys(o interface{}, keys []string, update func(lsp.DocumentURI) lsp.DocumentURI) {
+	keySet := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		keySet[k] = true
+	}
+
+	var walk func(o interface{}, parent string)
+	walk = func(o interface{}, parent string) {
+		switch o := o.(type) {
+		case map[string]interface{}:
+			for k, v := range o {
+				if keySet[k] {
+					if s, ok := v.(string); ok {
+						if update != nil && shouldWalkURI(lsp.DocumentURI(s)) {
+							o[k] = update(lsp.DocumentURI(s))
+						}
+						continue
+					}
+				}
+				// WorkspaceEdit.changes is a map keyed by document URI
+				// rather than a field named "uri".
+				if parent == "changes" && update != nil && shouldWalkURI(lsp.DocumentURI(k)) {
+					newURI := update(lsp.DocumentURI(k))
+					delete(o, k)
+					o[string(newURI)] = v
+				}
+				walk(v, k)
+			}
+		case []interface{}:
+			for k, v := range o {
+				walk(v, string(k))
+			}
+		}
+	}
+	walk(o, "top")
+}
+
+// walkURIFieldsGeneric is the original untyped walker: it treats any field
+// literally named "uri", "url", "rootPath", or "rootUri" anywhere in the
+// tree as a document URI, plus structs exposing a "URI" field via
+// reflection. It's the fallback for methods not covered by
+// uriKeysByMethod.
+func walkURIFieldsGeneric(o interface{}, update func(lsp.DocumentURI) lsp.DocumentURI) {
+	var walk func(o interface{}, parent string)
+	walk = func(o interface{}, parent string) {
+		switch o := o.(type) {
+		case map[string]interface{}: // Location, TextDocumentIdentifier, TextDocumentItem, etc.
+			for k, v := range o {
+				if k == "uri" || k == "url" || k == "rootPath" || k == "rootUri" {
+					s, ok := v.(string)
+					if !ok {
+						s2, ok2 := v.(lsp.DocumentURI)
+						s = string(s2)
+						ok = ok2
+					}
+					if ok {
+						if update != nil && shouldWalkURI(lsp.DocumentURI(s)) {
+							o[k] = update(lsp.DocumentURI(s))
+						}
+						continue
+					}
+				}
+				if parent == "changes" && update != nil && shouldWalkURI(lsp.DocumentURI(k)) {
+					newURI := update(lsp.DocumentURI(k))
+					delete(o, k)
+					o[string(newURI)] = v
+				}
+				walk(v, k)
+			}
+		case []interface{}: // Location[]
+			for k, v := range o {
+				walk(v, string(k))
+			}
+		default: // structs with a "URI" field
+			rv := reflect.ValueOf(o)
+			if rv.Kind() == reflect.Ptr {
+				rv = rv.Elem()
+			}
+			if rv.Kind() == reflect.Struct {
+				if fv := rv.FieldByName("URI"); fv.Kind() == reflect.String {
+					if update != nil && shouldWalkURI(lsp.DocumentURI(fv.String())) {
+						fv.SetString(string(update(lsp.DocumentURI(fv.String()))))
+					}
+				}
+				for i := 0; i < rv.NumField(); i++ {
+					fv := rv.Field(i)
+					if fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Struct || fv.Kind() == reflect.Array {
+						walk(fv.Interface(), "n/a")
+					}
+				}
+			}
+		}
+	}
+	walk(o, "top")
+}
+
+// shouldWalkURI consults the URI scheme handler registry so fields holding
+// a scheme WalkURIFields shouldn't rewrite (per URISchemeHandler.ShouldWalk)
+// are left alone instead of being run through update.
+func shouldWalkURI(uri lsp.DocumentURI) bool {
+	handler, _, err := schemeHandlerFor(uri)
+	if err != nil || handler == nil {
+		return true
+	}
+	return handler.ShouldWalk(uri)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+
+	"github.com/pkg/errors"
+)
+
+// cacheMaxBytes bounds the on-disk size of each workspace folder's lazy
+// cache; cacheVFS evicts least-recently-used files once it's exceeded. The
+// default (512MB) is generous enough for most repos' working sets while
+// still bounding a long-running session on a big one. <= 0 disables
+// eviction entirely.
+var cacheMaxBytes = flag.Int64("cacheMaxBytes", 512*1024*1024, "maximum on-disk size of each workspace folder's lazy file cache, in bytes (<= 0 disables eviction)")
+
+// cacheVFS is a lazy, file-on-demand view over a remoteFS. Rather than
+// cloning everything matching globs up front, it fetches a path the first
+// time something asks for it, and keeps the glob list only as a background
+// prefetch hint. An LRU, bounded by maxBytes, evicts cached files so a
+// long-running session on a big repo doesn't fill the disk.
+type cacheVFS struct {
+	fs    *remoteFS
+	root  string
+	globs []string
+
+	mu         sync.Mutex
+	fetched    map[string]bool
+	fetching   map[string]*sync.WaitGroup
+	generation map[string]int64
+	lru        *list.List
+	index      map[string]*list.Element
+	bytes      int64
+	maxBytes   int64
+}
+
+type cacheVFSEntry struct {
+	path string
+	size int64
+}
+
+func newCacheVFS(fs *remoteFS, root string, globs []string, maxBytes int64) *cacheVFS {
+	return &cacheVFS{
+		fs:         fs,
+		root:       root,
+		globs:      globs,
+		fetched:    make(map[string]bool),
+		fetching:   make(map[string]*sync.WaitGroup),
+		generation: make(map[string]int64),
+		lru:        list.New(),
+		index:      make(map[string]*list.Element),
+		maxBytes:   maxBytes,
+	}
+}
+
+// Prefetch walks v.globs over the remote connection in the background,
+// warming the cache without making the caller wait on it. It's only a
+// hint: a path outside the glob list is still fetched lazily on first
+// access via EnsureFetched.
+func (v *cacheVFS) Prefetch(ctx context.Context) {
+	go func() {
+		if err := v.fs.Clone(ctx, v.root, v.globs); err != nil {
+			log.Printf("cacheVFS: background prefetch of %s failed: %v", v.root, err)
+			return
+		}
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		filepath.Walk(v.root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info == nil || info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(v.root, p)
+			if err != nil {
+				return nil
+			}
+			v.fetched[rel] = true
+			v.recordLocked(rel, info.Size())
+			return nil
+		})
+		if err := v.evictLocked(""); err != nil {
+			log.Printf("cacheVFS: eviction after prefetch of %s failed: %v", v.root, err)
+		}
+	}()
+}
+
+// EnsureFetched fetches relPath into the cache if it hasn't been already,
+// and refreshes its LRU position either way. Concurrent calls for the same
+// not-yet-cached relPath wait on the in-flight fetch instead of each
+// issuing their own remote Clone. An Invalidate that lands while a fetch is
+// in flight bumps relPath's generation, so the fetch that was already
+// reading the pre-edit file is detected as stale and discarded instead of
+// being recorded as cached.
+func (v *cacheVFS) EnsureFetched(ctx context.Context, relPath string) error {
+	v.mu.Lock()
+	if v.fetched[relPath] {
+		v.touchLocked(relPath)
+		v.mu.Unlock()
+		return nil
+	}
+	if wg, ok := v.fetching[relPath]; ok {
+		v.mu.Unlock()
+		wg.Wait()
+		v.mu.Lock()
+		fetched := v.fetched[relPath]
+		v.mu.Unlock()
+		if !fetched {
+			return errors.Errorf("failed to lazily fetch %s", relPath)
+		}
+		return nil
+	}
+	startGen := v.generation[relPath]
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	v.fetching[relPath] = wg
+	v.mu.Unlock()
+
+	defer func() {
+		v.mu.Lock()
+		delete(v.fetching, relPath)
+		v.mu.Unlock()
+		wg.Done()
+	}()
+
+	if err := v.fs.Clone(ctx, v.root, []string{relPath}); err != nil {
+		return errors.Wrapf(err, "failed to lazily fetch %s", relPath)
+	}
+
+	info, err := os.Stat(filepath.Join(v.root, relPath))
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat lazily fetched file %s", relPath)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.generation[relPath] != startGen {
+		// relPath was invalidated while this fetch was in flight: the bytes
+		// just fetched are the pre-edit version. Discard them instead of
+		// recording relPath as cached, so the next access re-fetches.
+		if err := os.Remove(filepath.Join(v.root, relPath)); err != nil && !os.IsNotExist(err) {
+			log.Printf("cacheVFS: failed to remove stale fetch of invalidated file %s: %v", relPath, err)
+		}
+		return errors.Errorf("%s was invalidated while being fetched", relPath)
+	}
+	v.fetched[relPath] = true
+	v.recordLocked(relPath, info.Size())
+	return v.evictLocked(relPath)
+}
+
+// Invalidate drops relPath from the cache, including its on-disk copy, so
+// the next access re-fetches it from the client. The proxy calls this from
+// the textDocument/didChange handler so client-side edits reach the
+// downstream server before it next reads the file. Bumping the generation
+// counter here, even though relPath isn't necessarily being fetched right
+// now, is what lets a concurrent EnsureFetched detect that the copy it's
+// fetching was superseded.
+func (v *cacheVFS) Invalidate(relPath string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.generation[relPath]++
+	delete(v.fetched, relPath)
+	if el, ok := v.index[relPath]; ok {
+		v.lru.Remove(el)
+		delete(v.index, relPath)
+		v.bytes -= el.Value.(*cacheVFSEntry).size
+	}
+	if err := os.Remove(filepath.Join(v.root, relPath)); err != nil && !os.IsNotExist(err) {
+		log.Printf("cacheVFS: failed to remove invalidated file %s: %v", relPath, err)
+	}
+}
+
+func (v *cacheVFS) touchLocked(relPath string) {
+	if el, ok := v.index[relPath]; ok {
+		v.lru.MoveToFront(el)
+	}
+}
+
+func (v *cacheVFS) recordLocked(relPath string, size int64) {
+	if el, ok := v.index[relPath]; ok {
+		entry := el.Value.(*cacheVFSEntry)
+		v.bytes += size - entry.size
+		entry.size = size
+		v.lru.MoveToFront(el)
+		return
+	}
+	el := v.lru.PushFront(&cacheVFSEntry{path: relPath, size: size})
+	v.index[relPath] = el
+	v.bytes += size
+}
+
+// evictLocked removes least-recently-used entries until v.bytes is back
+// under maxBytes. maxBytes <= 0 disables eviction. protect names an entry
+// (typically the one a caller just fetched) that is never evicted, so a
+// single file larger than maxBytes doesn't get deleted out from under the
+// caller that just fetched it.
+func (v *cacheVFS) evictLocked(protect string) error {
+	if v.maxBytes <= 0 {
+		return nil
+	}
+	for v.bytes > v.maxBytes {
+		el := v.lru.Back()
+		if el == nil {
+			break
+		}
+		entry := el.Value.(*cacheVFSEntry)
+		if entry.path == protect {
+			break
+		}
+		if err := os.Remove(filepath.Join(v.root, entry.path)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to evict cached file %s", entry.path)
+		}
+		v.lru.Remove(el)
+		delete(v.index, entry.path)
+		delete(v.fetched, entry.path)
+		v.bytes -= entry.size
+	}
+	return nil
+}
+
+// folderVFS returns the lazy cache for folder, creating it (and kicking off
+// its background prefetch) on first use. p.vfs is shared across concurrent
+// proxy requests, so access to it is guarded by p.vfsMu.
+func (p *cloneProxy) folderVFS(folder workspaceFolder, globs []string) *cacheVFS {
+	p.vfsMu.Lock()
+	defer p.vfsMu.Unlock()
+
+	if p.vfs == nil {
+		p.vfs = make(map[string]*cacheVFS)
+	}
+	key := folder.cacheSubdir()
+	if v, ok := p.vfs[key]; ok {
+		return v
+	}
+
+	fs := &remoteFS{conn: p.client, traceID: p.sessionID.String()}
+	v := newCacheVFS(fs, p.folderCacheDir(folder), globs, *cacheMaxBytes)
+	v.Prefetch(p.ctx)
+	p.vfs[key] = v
+	return v
+}
+
+// EnsureCached lazily fetches relPath within folder, blocking the request
+// that triggered it until the file is on disk. ClientToServerURI invokes
+// this right after rewriting a URI into workspaceCacheDir().
+func (p *cloneProxy) EnsureCached(folder workspaceFolder, globs []string, relPath string) error {
+	return p.folderVFS(folder, globs).EnsureFetched(p.ctx, relPath)
+}
+
+// ClientToServerURI rewrites a client URI into the cache and, if it fell
+// within one of the tracked workspace folders, lazily fetches the target
+// file before returning so the downstream server can read it immediately.
+// This replaces cloneWorkspaceToCache's eager up-front clone: startup no
+// longer depends on the size of the repo.
+func (p *cloneProxy) ClientToServerURI(uri lsp.DocumentURI, globs []string) lsp.DocumentURI {
+	rewritten := clientToServerURI(uri, p.folderMappings())
+
+	folder, rel, ok := p.folderForClientURI(uri)
+	if !ok {
+		return rewritten
+	}
+	if err := p.EnsureCached(folder, globs, rel); err != nil {
+		log.Printf("ClientToServerURI: failed to lazily fetch %s: %v", rel, err)
+	}
+	return rewritten
+}
+
+// didChangeTextDocument invalidates the cache entry a client edit touched,
+// so a subsequent downstream read is lazily re-fetched instead of served
+// from a stale cached copy.
+func (p *cloneProxy) didChangeTextDocument(uri lsp.DocumentURI) {
+	folder, rel, ok := p.folderForClientURI(uri)
+	if !ok {
+		return
+	}
+	p.vfsMu.Lock()
+	v, ok := p.vfs[folder.cacheSubdir()]
+	p.vfsMu.Unlock()
+	if ok {
+		v.Invalidate(rel)
+	}
+}
+
+// folderForClientURI finds the workspace folder a client-side URI falls
+// under and the path relative to that folder's root.
+func (p *cloneProxy) folderForClientURI(uri lsp.DocumentURI) (workspaceFolder, string, bool) {
+	parsedURI, err := url.Parse(string(uri))
+	if err != nil {
+		return workspaceFolder{}, "", false
+	}
+
+	mapping, _ := bestMatchingFolder(normalizeURIPath(parsedURI.Path), p.folderMappings(), true)
+	if mapping == nil {
+		return workspaceFolder{}, "", false
+	}
+
+	for _, folder := range p.foldersSnapshot() {
+		if folder.URI != mapping.ClientURI {
+			continue
+		}
+		clientURI, err := url.Parse(string(folder.URI))
+		if err != nil {
+			return workspaceFolder{}, "", false
+		}
+		rel := pathTrimPrefix(normalizeURIPath(parsedURI.Path), normalizeURIPath(clientURI.Path))
+		return folder, rel, true
+	}
+	return workspaceFolder{}, "", false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+
+	"github.com/pkg/errors"
+)
+
+// workspaceFolder mirrors the LSP WorkspaceFolder type introduced in LSP
+// 3.6, which predates the vendored go-langserver lsp package.
+type workspaceFolder struct {
+	URI  lsp.DocumentURI `json:"uri"`
+	Name string          `json:"name"`
+}
+
+// cacheSubdir derives a stable, filesystem-safe directory name for a
+// workspace folder, unique to its full URI. Two folders with the same
+// basename (e.g. file:///a/src and file:///b/src) must not collide: they'd
+// clone into the same cache directory, and serverToClientURI's
+// longest-prefix match in bestMatchingFolder would then be unable to tell
+// which client folder a server-side path came back from. The declared name
+// is kept as a readable prefix; the hash of the full URI is what guarantees
+// uniqueness.
+func (f workspaceFolder) cacheSubdir() string {
+	sum := sha1.Sum([]byte(f.URI))
+	return fmt.Sprintf("%s-%x", sanitizeDirName(f.Name), sum[:4])
+}
+
+// sanitizeDirName replaces any character that isn't alphanumeric, a dash,
+// or an underscore with an underscore, so a workspace folder's declared
+// name is always safe to use as a path component.
+func sanitizeDirName(name string) string {
+	if name == "" {
+		return "folder"
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// folderCacheDir returns the directory that folder is cloned into under
+// workspaceCacheDir().
+func (p *cloneProxy) folderCacheDir(folder workspaceFolder) string {
+	return filepath.Join(p.workspaceCacheDir(), folder.cacheSubdir())
+}
+
+// cloneWorkspaceFoldersToCache registers every workspace folder reported by
+// the client's initialize request and starts its lazy cache. Folders are no
+// longer cloned eagerly: globs is kept only as a background prefetch hint
+// (see cacheVFS.Prefetch), and individual files are fetched on demand the
+// first time ClientToServerURI routes a URI into them.
+func (p *cloneProxy) cloneWorkspaceFoldersToCache(folders []workspaceFolder, globs []string) error {
+	for _, folder := range folders {
+		p.cloneWorkspaceFolderToCache(folder, globs)
+	}
+	p.foldersMu.Lock()
+	p.folders = folders
+	p.foldersMu.Unlock()
+	return nil
+}
+
+func (p *cloneProxy) cloneWorkspaceFolderToCache(folder workspaceFolder, globs []string) {
+	dir := p.folderCacheDir(folder)
+	p.folderVFS(folder, globs)
+	log.Printf("Started lazy cache for workspace folder %s at %s", folder.URI, dir)
+}
+
+// didChangeWorkspaceFolders handles the workspace/didChangeWorkspaceFolders
+// notification: newly added folders get a lazy cache started for them, and
+// removed folders have their cache directories deleted.
+func (p *cloneProxy) didChangeWorkspaceFolders(added, removed []workspaceFolder, globs []string) error {
+	for _, folder := range removed {
+		dir := p.folderCacheDir(folder)
+		log.Printf("Removing workspace folder cache for %s from %s", folder.URI, dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrapf(err, "failed to remove workspace folder cache %s", dir)
+		}
+		p.foldersMu.Lock()
+		p.folders = removeFolder(p.folders, folder.URI)
+		p.foldersMu.Unlock()
+	}
+
+	for _, folder := range added {
+		p.cloneWorkspaceFolderToCache(folder, globs)
+		p.foldersMu.Lock()
+		p.folders = append(p.folders, folder)
+		p.foldersMu.Unlock()
+	}
+
+	return nil
+}
+
+// folderMappings builds the client-to-cache routing table that
+// clientToServerURI and serverToClientURI use to pick the right folder for
+// a given URI.
+func (p *cloneProxy) folderMappings() []folderMapping {
+	p.foldersMu.Lock()
+	folders := append([]workspaceFolder(nil), p.folders...)
+	p.foldersMu.Unlock()
+
+	mappings := make([]folderMapping, len(folders))
+	for i, folder := range folders {
+		mappings[i] = folderMapping{ClientURI: folder.URI, CacheDir: p.folderCacheDir(folder)}
+	}
+	return mappings
+}
+
+// foldersSnapshot returns a copy of the proxy's current workspace folders,
+// safe to range over without racing a concurrent
+// didChangeWorkspaceFolders.
+func (p *cloneProxy) foldersSnapshot() []workspaceFolder {
+	p.foldersMu.Lock()
+	defer p.foldersMu.Unlock()
+	return append([]workspaceFolder(nil), p.folders...)
+}
+
+func removeFolder(folders []workspaceFolder, uri lsp.DocumentURI) []workspaceFolder {
+	out := folders[:0]
+	for _, f := range folders {
+		if f.URI != uri {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// supportsDidChangeWorkspaceFolders reports whether the downstream server's
+// capabilities set workspace.workspaceFolders.changeNotifications to true,
+// i.e. whether it wants workspace/didChangeWorkspaceFolders, so the
+// initialize forward knows whether to register it. Only the boolean form
+// is recognized; a string (registration ID) value yields false.
+func supportsDidChangeWorkspaceFolders(capabilities map[string]interface{}) bool {
+	workspace, ok := capabilities["workspace"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	wsFolders, ok := workspace["workspaceFolders"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	changeNotifications, _ := wsFolders["changeNotifications"].(bool)
+	return changeNotifications
+}